@@ -3,6 +3,7 @@ package midi
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	log "github.com/schollz/logger"
 	"github.com/schollz/portmidi"
@@ -10,8 +11,31 @@ import (
 )
 
 var outputStreams map[string]*portmidi.Stream
+var inputStreams map[string]*portmidi.Stream
 var encounteredNotes map[int64]struct{}
 var inited bool
+var listeners map[string]chan struct{}
+
+// Event is a decoded MIDI input message, independent of the portmidi
+// transport so that callers (e.g. sequencer.BindInput) never need to
+// import portmidi directly.
+type Event struct {
+	Status  int64
+	Channel int64
+	Data1   int64
+	Data2   int64
+}
+
+// NoteOn reports whether the event is a note-on with non-zero velocity.
+func (e Event) NoteOn() bool {
+	return e.Status&0xf0 == 0x90 && e.Data2 > 0
+}
+
+// NoteOff reports whether the event is a note-off, or a note-on with
+// zero velocity (which MIDI treats identically to note-off).
+func (e Event) NoteOff() bool {
+	return e.Status&0xf0 == 0x80 || (e.Status&0xf0 == 0x90 && e.Data2 == 0)
+}
 
 func Init() (devices []string, err error) {
 	defer func() {
@@ -26,7 +50,9 @@ func Init() (devices []string, err error) {
 	log.Debugf("found %d devices", portmidi.CountDevices())
 
 	outputStreams = make(map[string]*portmidi.Stream)
+	inputStreams = make(map[string]*portmidi.Stream)
 	encounteredNotes = make(map[int64]struct{})
+	listeners = make(map[string]chan struct{})
 	for i := 0; i < portmidi.CountDevices(); i++ {
 		di := portmidi.Info(portmidi.DeviceID(i))
 		log.Debugf("device %d: '%s', i/o: %v/%v", i, di.Name, di.IsInputAvailable, di.IsOutputAvailable)
@@ -38,12 +64,23 @@ func Init() (devices []string, err error) {
 				return
 			}
 		}
+		if di.IsInputAvailable && !strings.Contains(di.Name, "Microsoft") {
+			inputStreams[di.Name], err = portmidi.NewInputStream(portmidi.DeviceID(i), 4096)
+			if err != nil {
+				err = fmt.Errorf("could not get input from: '%s'", di.Name)
+				return
+			}
+		}
 	}
 	return
 }
 
 func Shutdown() (err error) {
 	inited = false
+	for _, stop := range listeners {
+		close(stop)
+	}
+	listeners = make(map[string]chan struct{})
 	err = NotesOff()
 	if err != nil {
 		log.Error(err)
@@ -51,9 +88,101 @@ func Shutdown() (err error) {
 	for out := range outputStreams {
 		outputStreams[out].Close()
 	}
+	for in := range inputStreams {
+		inputStreams[in].Close()
+	}
 	return portmidi.Terminate()
 }
 
+// Listen opens a stream of decoded Events from the named input device.
+// The channel is closed when Shutdown is called. Callers typically pass
+// the returned channel straight into sequencer.BindInput.
+func Listen(device string) (events <-chan Event, err error) {
+	if !inited {
+		err = fmt.Errorf("not initialized")
+		return
+	}
+	stream, ok := inputStreams[device]
+	if !ok {
+		err = fmt.Errorf("no such device: %s", device)
+		return
+	}
+	ch := make(chan Event, 64)
+	stop := make(chan struct{})
+	listeners[device] = stop
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			raw, errRead := stream.Read(1024)
+			if errRead != nil {
+				log.Error(errRead)
+				return
+			}
+			for _, e := range raw {
+				status := int64(e.Status)
+				channel := int64(0)
+				if status < 0xf0 {
+					// channel messages carry the channel in the low nibble;
+					// system realtime bytes (0xf8 clock, 0xfa/fb/fc
+					// start/continue/stop, ...) have no channel at all
+					channel = status & 0x0f
+					status = status & 0xf0
+				}
+				ch <- Event{
+					Status:  status,
+					Channel: channel,
+					Data1:   int64(e.Data1),
+					Data2:   int64(e.Data2),
+				}
+			}
+			if len(raw) == 0 {
+				time.Sleep(2 * time.Millisecond)
+			}
+		}
+	}()
+	events = ch
+	return
+}
+
+// Clock sends a single MIDI beat-clock byte (0xF8) to device. A master
+// sequencer calls this 24 times per quarter note.
+func Clock(device string) (err error) {
+	return sendRealtime(device, 0xF8)
+}
+
+// Start sends the MIDI transport start byte (0xFA) to device.
+func Start(device string) (err error) {
+	return sendRealtime(device, 0xFA)
+}
+
+// Stop sends the MIDI transport stop byte (0xFC) to device.
+func Stop(device string) (err error) {
+	return sendRealtime(device, 0xFC)
+}
+
+// Continue sends the MIDI transport continue byte (0xFB) to device.
+func Continue(device string) (err error) {
+	return sendRealtime(device, 0xFB)
+}
+
+func sendRealtime(device string, status int64) (err error) {
+	if !inited {
+		err = fmt.Errorf("not initialized")
+		return
+	}
+	out, ok := outputStreams[device]
+	if !ok {
+		err = fmt.Errorf("no such device: %s", device)
+		return
+	}
+	return out.WriteShort(status, 0, 0)
+}
+
 func NotesOff() (err error) {
 	for out := range outputStreams {
 		for note := range encounteredNotes {
@@ -64,17 +193,47 @@ func NotesOff() (err error) {
 	return
 }
 
-func Midi(msg string, chord music.Chord) (err error) {
+// NotesOffDevice sends note-off for every note encountered so far to a
+// single output device, rather than all of them. A hot-reloaded sequence
+// uses this to silence an instrument that disappeared from the new
+// definition without cutting off notes still playing on other devices.
+func NotesOffDevice(device string) (err error) {
+	out, ok := outputStreams[device]
+	if !ok {
+		err = fmt.Errorf("no such device: %s", device)
+		return
+	}
+	for note := range encounteredNotes {
+		log.Tracef("'%s' %d off ", device, note)
+		err = out.WriteShort(0x80, note, 100)
+	}
+	return
+}
+
+// Midi sends chord (if it has any notes) and cc (if non-nil) to the named
+// output device on the given channel (0-15). Per-note velocities come
+// from chord.Velocities, falling back to 100 for any note missing one.
+func Midi(msg string, channel int64, chord music.Chord, cc *music.CC) (err error) {
 	log.Trace("got emit")
 	if !inited {
 		err = fmt.Errorf("not initialized")
 		return
 	}
-	if len(chord.Notes) == 0 {
+	out, ok := outputStreams[msg]
+	if !ok {
+		err = fmt.Errorf("no such device: %s", msg)
 		return
 	}
-	if _, ok := outputStreams[msg]; !ok {
-		err = fmt.Errorf("no such device: %s", msg)
+	if cc != nil {
+		for _, v := range cc.Values {
+			log.Tracef("[%s] cc %d=%d (ch %d)", msg, cc.Number, v, channel)
+			err = out.WriteShort(0xB0|channel, cc.Number, v)
+			if err != nil {
+				return
+			}
+		}
+	}
+	if len(chord.Notes) == 0 {
 		return
 	}
 	log.Trace("building midi")
@@ -83,14 +242,18 @@ func Midi(msg string, chord music.Chord) (err error) {
 	for i, n := range chord.Notes {
 		midis[i] = int64(n.MIDI)
 		encounteredNotes[midis[i]] = struct{}{}
-		velocities[i] = 100
+		if i < len(chord.Velocities) {
+			velocities[i] = chord.Velocities[i]
+		} else {
+			velocities[i] = 100
+		}
 	}
 	log.Trace("sending midi")
 	if chord.On {
 		log.Tracef("[%s] %+v", msg, midis)
-		err = outputStreams[msg].WriteShorts(0x90, midis, velocities)
+		err = out.WriteShorts(0x90|channel, midis, velocities)
 	} else {
-		err = outputStreams[msg].WriteShorts(0x80, midis, velocities)
+		err = out.WriteShorts(0x80|channel, midis, velocities)
 	}
 	log.Trace("sent")
 	if err != nil {
@@ -4,19 +4,37 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"math/rand"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/schollz/miti/src/click"
 	"github.com/schollz/miti/src/log"
 	"github.com/schollz/miti/src/metronome"
+	"github.com/schollz/miti/src/midi"
 	"github.com/schollz/miti/src/music"
 )
 
 const QUARTERNOTES_PER_MEASURE = 4
 
+// SyncMode selects how a Sequencer relates to MIDI beat clock.
+type SyncMode int
+
+const (
+	// SyncNone runs the internal metronome and does not touch MIDI clock.
+	SyncNone SyncMode = iota
+	// SyncMaster runs the internal metronome and also emits MIDI beat
+	// clock (0xF8) plus start/stop/continue to SyncDevice.
+	SyncMaster
+	// SyncSlave disables the internal metronome; Emit is instead driven
+	// by incoming MIDI beat clock via BindSync.
+	SyncSlave
+)
+
 type Sequencer struct {
 	metronome *metronome.Metronome
 	Sections  []Section
@@ -26,12 +44,70 @@ type Sequencer struct {
 	sectionID int
 
 	measure, section int
-	midiPlay         func(string, music.Chord)
+	midiPlay         func(string, int64, music.Chord, *music.CC)
 	latency          int64
 	clickTrack       bool
+
+	transpose map[string]int64
+	armed     map[string]bool
+	tapTimes  []time.Time
+
+	// totalPulse counts every pulse the metronome has ever emitted,
+	// independent of s.measure/s.section. Each part indexes its own
+	// Measures off how far totalPulse has advanced since sectionStartPulse,
+	// so a 7/8 part can run alongside a 4/4 one within the same section
+	// without either resetting the other, while every part still restarts
+	// at Measures[0] when a new section begins.
+	totalPulse        int64
+	sectionStartPulse int64
+
+	syncMode    SyncMode
+	syncDevice  string
+	syncStarted bool
+	// masterClockAcc accumulates 24.0/PULSES_PER_QUARTER_NOTE per internal
+	// pulse so a SyncMaster sends exactly the MIDI standard's 24 clocks
+	// per quarter note regardless of the internal pulse resolution - the
+	// inverse of the mapping BindSync uses on the slave side.
+	masterClockAcc float64
+
+	// shadow* hold a re-parsed file staged by WatchFile until Emit can
+	// swap it in at a phrase boundary without dropping notes-in-flight.
+	shadowPending bool
+	shadowChain   []string
+	shadowChainID map[string]int
+	shadowSection []Section
+
+	// rng resolves every random pattern-line decision (probability gates,
+	// random choice) during parsing. It defaults to a time-seeded source
+	// so unseeded files still vary run to run; a `seed N` directive in
+	// the file replaces it with a seeded source for the rest of that
+	// parse (s.rng itself is left as is), so tokens after the seed always
+	// parse identically.
+	rng *rand.Rand
 	sync.Mutex
 }
 
+// BindingCfg configures how an incoming stream of midi.Events, bound via
+// BindInput, is allowed to mutate a running Sequencer.
+type BindingCfg struct {
+	// TransposeChannel is the MIDI channel (0-indexed) whose NoteOn
+	// transposes Instruments by (received pitch - ReferencePitch) semitones.
+	TransposeChannel int64
+	ReferencePitch   int64
+	Instruments      []string
+
+	// TriggerChannel is the MIDI channel used to arm/disarm sections.
+	// NoteOn arms the mapped section, NoteOff disarms it.
+	TriggerChannel  int64
+	TriggerSections map[int64]string
+
+	// TapTempoNotes are the two note numbers (on any channel) that,
+	// when struck, average the last TapTempoAverage inter-onset
+	// intervals into a new tempo via UpdateTempo.
+	TapTempoNotes   [2]int64
+	TapTempoAverage int
+}
+
 type Section struct {
 	Name        string
 	Parts       []Part
@@ -44,6 +120,16 @@ type Part struct {
 	Instruments []string
 	Measures    []Measure
 	Legato      int
+	// Channel is the MIDI channel (0-15) this part's instruments send on.
+	// Set explicitly with a `channel N` directive, otherwise assigned
+	// round-robin as parts are parsed.
+	Channel int64
+	// PulsesPerMeasure is how many pulses this part's own measure spans,
+	// set by a `meter N/D` directive (default 4/4, i.e.
+	// QUARTERNOTES_PER_MEASURE*PULSES_PER_QUARTER_NOTE). Parts may run
+	// polymetrically against each other since each tracks its own cursor
+	// over the shared pulse clock; see Sequencer.Emit.
+	PulsesPerMeasure int
 }
 
 // Measure is all the notes contained within 4-beats
@@ -51,32 +137,188 @@ type Measure struct {
 	// Emit contains the data that will be emitted
 	Emit   map[int][]music.Chord
 	Chords []music.Chord
+	// CCEmit lays a continuous-controller lane across the same pulse
+	// grid as Emit, one music.CC message per pulse it's set at.
+	CCEmit map[int]music.CC
 }
 
-func New(clickTrack bool, latency int64, midiPlay func(string, music.Chord)) (s *Sequencer) {
+func New(clickTrack bool, latency int64, midiPlay func(string, int64, music.Chord, *music.CC), syncMode SyncMode, syncDevice string) (s *Sequencer) {
 	s = new(Sequencer)
 	s.metronome = metronome.New(s.Emit)
 	s.midiPlay = midiPlay
 	s.latency = latency
 	s.clickTrack = clickTrack
 	s.chainID = make(map[string]int)
+	s.transpose = make(map[string]int64)
+	s.armed = make(map[string]bool)
+	s.syncMode = syncMode
+	s.syncDevice = syncDevice
+	s.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 	return
 }
 
+// BindInput wires a channel of live midi.Events into the Sequencer so a
+// controller can transpose instruments, arm/disarm sections, and
+// tap-tempo the metronome while it runs. It reads ch until the channel
+// is closed (e.g. by midi.Shutdown) and mutates the Sequencer under its
+// lock, so it is safe to call alongside a running metronome.
+func (s *Sequencer) BindInput(ch <-chan midi.Event, cfg BindingCfg) {
+	if cfg.TapTempoAverage < 1 {
+		cfg.TapTempoAverage = 1
+	}
+	go func() {
+		for e := range ch {
+			if e.Channel == cfg.TransposeChannel && e.NoteOn() {
+				offset := e.Data1 - cfg.ReferencePitch
+				s.Lock()
+				for _, instrument := range cfg.Instruments {
+					s.transpose[instrument] = offset
+				}
+				s.Unlock()
+			}
+			if e.Channel == cfg.TriggerChannel && (e.NoteOn() || e.NoteOff()) {
+				if name, ok := cfg.TriggerSections[e.Data1]; ok {
+					s.Lock()
+					s.armed[name] = e.NoteOn()
+					s.Unlock()
+				}
+			}
+			if e.NoteOn() && (e.Data1 == cfg.TapTempoNotes[0] || e.Data1 == cfg.TapTempoNotes[1]) {
+				s.tapTempo(cfg.TapTempoAverage)
+			}
+		}
+	}()
+}
+
+func (s *Sequencer) tapTempo(average int) {
+	now := time.Now()
+	s.Lock()
+	s.tapTimes = append(s.tapTimes, now)
+	if len(s.tapTimes) > average+1 {
+		s.tapTimes = s.tapTimes[len(s.tapTimes)-(average+1):]
+	}
+	if len(s.tapTimes) < 2 {
+		s.Unlock()
+		return
+	}
+	var total time.Duration
+	for i := 1; i < len(s.tapTimes); i++ {
+		total += s.tapTimes[i].Sub(s.tapTimes[i-1])
+	}
+	avgInterval := total / time.Duration(len(s.tapTimes)-1)
+	s.Unlock()
+	if avgInterval <= 0 {
+		return
+	}
+	s.UpdateTempo(60.0 / avgInterval.Seconds())
+}
+
+// sectionDisarmed reports whether name has been explicitly disarmed via
+// BindInput's trigger channel. Sections are armed by default.
+func (s *Sequencer) sectionDisarmed(name string) bool {
+	armed, ok := s.armed[name]
+	return ok && !armed
+}
+
+// transposeChord returns chord with every note shifted by whatever
+// transpose offset is currently bound to instrument, if any.
+func (s *Sequencer) transposeChord(instrument string, chord music.Chord) music.Chord {
+	offset, ok := s.transpose[instrument]
+	if !ok || offset == 0 {
+		return chord
+	}
+	notes := make([]music.Note, len(chord.Notes))
+	copy(notes, chord.Notes)
+	for i := range notes {
+		notes[i].MIDI += int(offset)
+	}
+	chord.Notes = notes
+	return chord
+}
+
 func (s *Sequencer) Start() {
 	s.measure = -1
 	s.section = 0
+	s.sectionStartPulse = s.totalPulse
 	if s.clickTrack {
 		click.Play(60)
 	}
 	if len(s.Sections) > 0 {
 		s.UpdateTempo(s.Sections[s.chainID[s.chain[s.section]]].Tempo)
 	}
-	s.metronome.Start()
+	if s.syncMode == SyncMaster && s.syncDevice != "" {
+		var errSync error
+		if s.syncStarted {
+			errSync = midi.Continue(s.syncDevice)
+		} else {
+			errSync = midi.Start(s.syncDevice)
+			s.syncStarted = true
+		}
+		if errSync != nil {
+			log.Error(errSync)
+		}
+	}
+	// a slaved sequencer is driven by BindSync off external clock instead
+	if s.syncMode != SyncSlave {
+		s.metronome.Start()
+	}
 }
 
 func (s *Sequencer) Stop() {
-	s.metronome.Stop()
+	if s.syncMode != SyncSlave {
+		s.metronome.Stop()
+	}
+	if s.syncMode == SyncMaster && s.syncDevice != "" {
+		if err := midi.Stop(s.syncDevice); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// BindSync drives Emit directly from an external MIDI beat clock when
+// the Sequencer is configured with SyncSlave. Every incoming 0xF8 clock
+// byte advances the internal pulse counter (mapping the 24 pulses per
+// quarter note of the MIDI clock standard onto whatever resolution
+// metronome.PULSES_PER_QUARTER_NOTE uses internally), and UpdateTempo is
+// re-derived from a moving average of the last clockAverage intervals.
+func (s *Sequencer) BindSync(ch <-chan midi.Event, clockAverage int) {
+	if clockAverage < 1 {
+		clockAverage = 1
+	}
+	const externalPPQ = 24.0
+	internalPerExternal := float64(metronome.PULSES_PER_QUARTER_NOTE) / externalPPQ
+	go func() {
+		var clockTimes []time.Time
+		acc := 0.0
+		pulse := 0
+		measureLen := QUARTERNOTES_PER_MEASURE * metronome.PULSES_PER_QUARTER_NOTE
+		for e := range ch {
+			if e.Status != 0xF8 {
+				continue
+			}
+			now := time.Now()
+			clockTimes = append(clockTimes, now)
+			if len(clockTimes) > clockAverage+1 {
+				clockTimes = clockTimes[len(clockTimes)-(clockAverage+1):]
+			}
+			if len(clockTimes) >= 2 {
+				var total time.Duration
+				for i := 1; i < len(clockTimes); i++ {
+					total += clockTimes[i].Sub(clockTimes[i-1])
+				}
+				avg := total / time.Duration(len(clockTimes)-1)
+				if avg > 0 {
+					s.UpdateTempo(60.0 / (avg.Seconds() * externalPPQ))
+				}
+			}
+			acc += internalPerExternal
+			for acc >= 1 {
+				acc -= 1
+				s.Emit(pulse)
+				pulse = (pulse + 1) % measureLen
+			}
+		}
+	}()
 }
 
 func (s *Sequencer) UpdateTempo(tempo float64) {
@@ -92,14 +334,33 @@ func (s *Sequencer) Emit(pulse int) {
 	if len(s.Sections) == 0 {
 		return
 	}
+	defer func() { s.totalPulse++ }()
+
+	if s.syncMode == SyncMaster && s.syncDevice != "" {
+		const externalPPQ = 24.0
+		s.masterClockAcc += externalPPQ / float64(metronome.PULSES_PER_QUARTER_NOTE)
+		for s.masterClockAcc >= 1 {
+			s.masterClockAcc -= 1
+			if err := midi.Clock(s.syncDevice); err != nil {
+				log.Error(err)
+			}
+		}
+	}
 
 	if pulse == 0 {
 		s.measure++
 		if s.measure == s.Sections[s.sectionID].NumMeasures {
 			s.section++
 			s.section = s.section % len(s.chain)
+			// sections are armed by default; skip any explicitly disarmed
+			// via BindInput's trigger channel, without looping forever if
+			// every section has been disarmed
+			for skipped := 0; skipped < len(s.chain) && s.sectionDisarmed(s.chain[s.section]); skipped++ {
+				s.section = (s.section + 1) % len(s.chain)
+			}
 			s.sectionID = s.chainID[s.chain[s.section]]
 			s.measure = 0
+			s.sectionStartPulse = s.totalPulse
 
 			// update tempo for new section
 			if s.Sections[s.sectionID].Tempo != 0 {
@@ -108,18 +369,38 @@ func (s *Sequencer) Emit(pulse int) {
 		}
 		log.Trace(s.section, s.measure, pulse)
 	}
+
+	// a hot-reloaded file only ever swaps in at the start of a phrase -
+	// pulse 0 of measure 0 of whatever section is currently playing -
+	// so notes already in flight are never cut off mid-measure
+	if pulse == 0 && s.measure == 0 && s.shadowPending {
+		s.swapShadow()
+	}
+
 	if s.clickTrack && math.Mod(float64(pulse), metronome.PULSES_PER_QUARTER_NOTE) == 0 {
 		log.Trace("should click!")
 		click.Click(s.latency)
 	}
 
-	// check for notes to emit
+	// check for notes to emit. Each part wraps its own pulse cursor off
+	// how far totalPulse has advanced since the current section started,
+	// so a 7/8 part can emit independently of a 4/4 part within the same
+	// section, while every part still restarts at Measures[0] when a new
+	// section begins instead of drifting into whatever measure its global
+	// pulse count happens to land on.
+	sectionPulse := s.totalPulse - s.sectionStartPulse
 	for _, part := range s.Sections[s.sectionID].Parts {
 		if len(part.Measures) == 0 {
 			continue
 		}
-		measure := part.Measures[s.measure%len(part.Measures)]
-		if e, ok := measure.Emit[pulse]; ok {
+		pulsesPerMeasure := part.PulsesPerMeasure
+		if pulsesPerMeasure <= 0 {
+			pulsesPerMeasure = QUARTERNOTES_PER_MEASURE * metronome.PULSES_PER_QUARTER_NOTE
+		}
+		partPulse := int(sectionPulse % int64(pulsesPerMeasure))
+		partMeasureIdx := int((sectionPulse / int64(pulsesPerMeasure)) % int64(len(part.Measures)))
+		measure := part.Measures[partMeasureIdx]
+		if e, ok := measure.Emit[partPulse]; ok {
 			// emit
 			log.Tracef("[%s] emit %+v", strings.Join(part.Instruments, ", "), e)
 			for _, instrument := range part.Instruments {
@@ -128,25 +409,351 @@ func (s *Sequencer) Emit(pulse int) {
 				for _, chord := range e {
 					if chord.On {
 						chordOn.Notes = append(chordOn.Notes, chord.Notes...)
+						chordOn.Velocities = append(chordOn.Velocities, chord.Velocities...)
 					} else {
 						chordOff.Notes = append(chordOff.Notes, chord.Notes...)
+						chordOff.Velocities = append(chordOff.Velocities, chord.Velocities...)
 					}
 				}
 				if len(chordOff.Notes) > 0 {
-					//midi.Midi(instrument, chordOff)
-					s.midiPlay(instrument, chordOff)
+					//midi.Midi(instrument, part.Channel, chordOff, nil)
+					s.midiPlay(instrument, part.Channel, s.transposeChord(instrument, chordOff), nil)
 				}
 				if len(chordOn.Notes) > 0 {
-					//midi.Midi(instrument, chordOn)
-					s.midiPlay(instrument, chordOn)
+					//midi.Midi(instrument, part.Channel, chordOn, nil)
+					s.midiPlay(instrument, part.Channel, s.transposeChord(instrument, chordOn), nil)
 				}
 			}
 			log.Trace("finished emitting")
 		}
+		if cc, ok := measure.CCEmit[partPulse]; ok {
+			log.Tracef("[%s] emit cc %+v", strings.Join(part.Instruments, ", "), cc)
+			for _, instrument := range part.Instruments {
+				s.midiPlay(instrument, part.Channel, music.Chord{}, &cc)
+			}
+		}
+	}
+}
+
+// bjorklund computes a Euclidean rhythm of k hits spread as evenly as
+// possible over n steps. It starts with k groups of [1] and (n-k) groups
+// of [0], then repeatedly pairs groups off the front with groups off the
+// back - folding whichever side has leftovers into the new back - until
+// fewer than 2 groups remain in the back, then flattens front+back into
+// the hit/rest sequence.
+func bjorklund(k, n int) []bool {
+	if k < 0 {
+		k = 0
+	}
+	if k > n {
+		k = n
+	}
+	if k == 0 {
+		return make([]bool, n)
+	}
+	front := make([][]int, k)
+	for i := range front {
+		front[i] = []int{1}
+	}
+	back := make([][]int, n-k)
+	for i := range back {
+		back[i] = []int{0}
+	}
+	for len(back) > 1 {
+		m := len(front)
+		if len(back) < m {
+			m = len(back)
+		}
+		paired := make([][]int, m)
+		for i := 0; i < m; i++ {
+			paired[i] = append(append([]int{}, front[i]...), back[i]...)
+		}
+		var remainder [][]int
+		if len(front) > m {
+			remainder = front[m:]
+		} else {
+			remainder = back[m:]
+		}
+		front = paired
+		back = remainder
+	}
+	flat := make([]int, 0, n)
+	for _, g := range front {
+		flat = append(flat, g...)
+	}
+	for _, g := range back {
+		flat = append(flat, g...)
+	}
+	hits := make([]bool, len(flat))
+	for i, v := range flat {
+		hits[i] = v == 1
 	}
+	return hits
+}
+
+// expandPatternTokens resolves the procedural pattern-line tokens - an
+// "E(k,n) NOTE" euclidean rhythm, a "?P:NOTE" probability gate, and a
+// "[A|B|C]" uniform random choice - into plain note/rest tokens before
+// expandTuplets or the per-cluster parser ever see them. Every random
+// decision is drawn from rng, so the same file parsed with the same
+// `seed` always expands to the same tokens.
+func expandPatternTokens(fs []string, rng *rand.Rand) (out []string, err error) {
+	for i := 0; i < len(fs); i++ {
+		tok := fs[i]
+		switch {
+		case strings.HasPrefix(tok, "E("):
+			spec := strings.TrimSuffix(strings.TrimPrefix(tok, "E("), ")")
+			kn := strings.SplitN(spec, ",", 2)
+			if len(kn) != 2 {
+				err = fmt.Errorf("problem parsing euclidean rhythm: %s", tok)
+				return
+			}
+			var k, n int
+			k, err = strconv.Atoi(strings.TrimSpace(kn[0]))
+			if err != nil {
+				err = fmt.Errorf("problem parsing euclidean hits: %s", tok)
+				return
+			}
+			n, err = strconv.Atoi(strings.TrimSpace(kn[1]))
+			if err != nil {
+				err = fmt.Errorf("problem parsing euclidean steps: %s", tok)
+				return
+			}
+			if n <= 0 {
+				err = fmt.Errorf("euclidean rhythm needs at least one step: %s", tok)
+				return
+			}
+			i++
+			if i >= len(fs) {
+				err = fmt.Errorf("%s needs a note to place", tok)
+				return
+			}
+			note := fs[i]
+			for _, hit := range bjorklund(k, n) {
+				if hit {
+					out = append(out, note)
+				} else {
+					out = append(out, ".")
+				}
+			}
+		case strings.HasPrefix(tok, "?"):
+			spec := strings.TrimPrefix(tok, "?")
+			idx := strings.Index(spec, ":")
+			if idx < 0 {
+				err = fmt.Errorf("problem parsing probability gate: %s", tok)
+				return
+			}
+			var p float64
+			p, err = strconv.ParseFloat(spec[:idx], 64)
+			if err != nil {
+				err = fmt.Errorf("problem parsing probability: %s", tok)
+				return
+			}
+			if rng.Float64() < p {
+				out = append(out, spec[idx+1:])
+			} else {
+				out = append(out, ".")
+			}
+		case strings.HasPrefix(tok, "[") && strings.HasSuffix(tok, "]"):
+			options := strings.Split(strings.TrimSuffix(strings.TrimPrefix(tok, "["), "]"), "|")
+			for _, opt := range options {
+				if opt == "" {
+					err = fmt.Errorf("empty random choice alternative: %s", tok)
+					return
+				}
+			}
+			out = append(out, options[rng.Intn(len(options))])
+		default:
+			out = append(out, tok)
+		}
+	}
+	return
+}
+
+// expandTuplets walks a pattern line's whitespace-separated fields and
+// expands any "(N tok1 ... tokN)" or "(N M tok1 ... tokN)" tuplet group
+// into its member clusters, each paired with the grid-weight it should
+// occupy relative to an ordinary field (weight 1). "(3 C4 D4 E4)" packs
+// 3 notes into the space 2 ordinary fields would take (M defaults to
+// N-1, the classic tuplet ratio); "(N M ...)" spells out M explicitly.
+func expandTuplets(fs []string) (units []string, weights []float64, err error) {
+	for i := 0; i < len(fs); {
+		tok := fs[i]
+		if !strings.HasPrefix(tok, "(") {
+			units = append(units, tok)
+			weights = append(weights, 1)
+			i++
+			continue
+		}
+		var n int
+		n, err = strconv.Atoi(strings.TrimPrefix(tok, "("))
+		if err != nil {
+			err = fmt.Errorf("problem parsing tuplet count: %s", tok)
+			return
+		}
+		i++
+		m := n - 1
+		if i < len(fs) {
+			if mm, errM := strconv.Atoi(fs[i]); errM == nil {
+				m = mm
+				i++
+			}
+		}
+		group := make([]string, 0, n)
+		for len(group) < n {
+			if i >= len(fs) {
+				err = fmt.Errorf("unterminated tuplet group starting at %s", tok)
+				return
+			}
+			t := fs[i]
+			i++
+			closed := strings.HasSuffix(t, ")")
+			if closed {
+				t = strings.TrimSuffix(t, ")")
+			}
+			group = append(group, t)
+			if closed {
+				break
+			}
+		}
+		if len(group) != n {
+			err = fmt.Errorf("tuplet %s expected %d notes, got %d", tok, n, len(group))
+			return
+		}
+		for _, t := range group {
+			units = append(units, t)
+			weights = append(weights, float64(m)/float64(n))
+		}
+	}
+	return
 }
 
 func (s *Sequencer) Parse(fname string) (err error) {
+	s.Lock()
+	rng := s.rng
+	s.Unlock()
+	chain, chainID, sections, err := parseMitiFile(fname, rng)
+	if err != nil {
+		return
+	}
+	s.Lock()
+	s.chain = chain
+	s.chainID = chainID
+	s.Sections = sections
+	s.Unlock()
+	return
+}
+
+// WatchFile re-parses fname on every save and stages the result for a
+// hot-reload instead of installing it immediately: Parse's direct install
+// could land mid-measure and drop notes-in-flight, so the new chain/
+// sections sit in s.shadow* until Emit reaches a phrase boundary (pulse 0
+// of measure 0) and calls swapShadow. The watch runs until fname's
+// directory can no longer be watched; callers normally start it once,
+// right after the initial Parse, and let it run for the life of the
+// process.
+func (s *Sequencer) WatchFile(fname string) (err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(fname)
+	if err = watcher.Add(dir); err != nil {
+		return
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(fname) {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+				s.Lock()
+				rng := s.rng
+				s.Unlock()
+				chain, chainID, sections, errParse := parseMitiFile(fname, rng)
+				if errParse != nil {
+					log.Error(errParse)
+					continue
+				}
+				s.Lock()
+				s.shadowChain = chain
+				s.shadowChainID = chainID
+				s.shadowSection = sections
+				s.shadowPending = true
+				s.Unlock()
+				log.Infof("staged reload of '%s', will swap at next phrase boundary", fname)
+			case errWatch, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error(errWatch)
+			}
+		}
+	}()
+	return
+}
+
+// swapShadow installs a shadow sequence staged by WatchFile, sending an
+// all-notes-off to any instrument that is no longer present so it doesn't
+// hang a stuck note. Callers must hold s.Lock.
+func (s *Sequencer) swapShadow() {
+	oldInstruments := make(map[string]struct{})
+	for _, section := range s.Sections {
+		for _, part := range section.Parts {
+			for _, instrument := range part.Instruments {
+				oldInstruments[instrument] = struct{}{}
+			}
+		}
+	}
+	newInstruments := make(map[string]struct{})
+	for _, section := range s.shadowSection {
+		for _, part := range section.Parts {
+			for _, instrument := range part.Instruments {
+				newInstruments[instrument] = struct{}{}
+			}
+		}
+	}
+	for instrument := range oldInstruments {
+		if _, ok := newInstruments[instrument]; !ok {
+			if err := midi.NotesOffDevice(instrument); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	s.chain = s.shadowChain
+	s.chainID = s.shadowChainID
+	s.Sections = s.shadowSection
+	s.shadowChain = nil
+	s.shadowChainID = nil
+	s.shadowSection = nil
+	s.shadowPending = false
+
+	// s.section/s.sectionID/s.measure were all computed against the old
+	// chain and may no longer be valid indexes into the swapped-in one
+	// (e.g. a shorter chain) - restart from its first section rather than
+	// index off stale state.
+	s.section = 0
+	s.sectionID = s.chainID[s.chain[0]]
+	s.measure = 0
+	s.sectionStartPulse = s.totalPulse
+}
+
+// parseMitiFile reads and parses fname into a chain/section definition
+// without installing it into any Sequencer. Parse installs the result
+// immediately; WatchFile stages it for a phrase-boundary swap instead.
+// rng resolves any random pattern-line tokens (see expandPatternTokens);
+// a `seed N` directive in the file reseeds it from that point on, so a
+// given file/seed always parses to the same Sections.
+func parseMitiFile(fname string, rng *rand.Rand) (chain []string, chainID map[string]int, sections []Section, err error) {
 	startTime := time.Now()
 	defer func() {
 		log.Infof("parsed sequence '%s' in %2.1f ms", fname, 1000*time.Since(startTime).Seconds())
@@ -163,6 +770,7 @@ func (s *Sequencer) Parse(fname string) (err error) {
 
 	var section Section
 	var part Part
+	var nextChannel int64
 	for _, line := range strings.Split(data, "\n") {
 		line = strings.TrimSpace(line)
 		log.Tracef("parsing %s", line)
@@ -200,6 +808,129 @@ func (s *Sequencer) Parse(fname string) (err error) {
 					part.Legato = 100
 				}
 			}
+		} else if strings.HasPrefix(line, "channel") {
+			fs := strings.Fields(line)
+			if len(fs) > 1 {
+				var ch int64
+				ch, err = strconv.ParseInt(fs[1], 10, 64)
+				if err != nil {
+					err = fmt.Errorf("problem parsing channel: %s", fs[1])
+					return
+				}
+				if ch < 0 {
+					ch = 0
+				} else if ch > 15 {
+					ch = 15
+				}
+				part.Channel = ch
+			}
+		} else if strings.HasPrefix(line, "meter") {
+			fs := strings.Fields(line)
+			if len(fs) > 1 {
+				nd := strings.SplitN(fs[1], "/", 2)
+				if len(nd) != 2 {
+					err = fmt.Errorf("problem parsing meter: %s", fs[1])
+					return
+				}
+				var num, den int
+				num, err = strconv.Atoi(nd[0])
+				if err != nil {
+					err = fmt.Errorf("problem parsing meter numerator: %s", nd[0])
+					return
+				}
+				den, err = strconv.Atoi(nd[1])
+				if err != nil {
+					err = fmt.Errorf("problem parsing meter denominator: %s", nd[1])
+					return
+				}
+				if num < 1 || den < 1 {
+					err = fmt.Errorf("invalid meter: %s", fs[1])
+					return
+				}
+				part.PulsesPerMeasure = int(math.Round(float64(num) / float64(den) * 4 * metronome.PULSES_PER_QUARTER_NOTE))
+			}
+		} else if strings.HasPrefix(line, "cc") {
+			fs := strings.Fields(line)
+			if len(fs) < 3 {
+				err = fmt.Errorf("cc line needs a controller number and at least one value: %s", line)
+				return
+			}
+			if len(part.Measures) == 0 {
+				err = fmt.Errorf("cc line must follow a pattern line within the same part: %s", line)
+				return
+			}
+			var ccNum int64
+			ccNum, err = strconv.ParseInt(fs[1], 10, 64)
+			if err != nil {
+				err = fmt.Errorf("problem parsing cc number: %s", fs[1])
+				return
+			}
+			if ccNum < 0 {
+				ccNum = 0
+			} else if ccNum > 127 {
+				ccNum = 127
+			}
+			anchors := fs[2:]
+			totalPulses := part.PulsesPerMeasure
+			anchorPulse := make([]int, len(anchors))
+			anchorValue := make([]int64, len(anchors))
+			anchorSet := make([]bool, len(anchors))
+			for i, a := range anchors {
+				p := math.Round(float64(i) / float64(len(anchors)) * float64(totalPulses-1))
+				anchorPulse[i] = int(p)
+				if a == "-" || a == "." {
+					continue
+				}
+				var v int64
+				v, err = strconv.ParseInt(a, 10, 64)
+				if err != nil {
+					err = fmt.Errorf("problem parsing cc value: %s", a)
+					return
+				}
+				if v < 0 {
+					v = 0
+				} else if v > 127 {
+					v = 127
+				}
+				anchorValue[i] = v
+				anchorSet[i] = true
+			}
+			measure := &part.Measures[len(part.Measures)-1]
+			if measure.CCEmit == nil {
+				measure.CCEmit = make(map[int]music.CC)
+			}
+			prev := -1
+			for i := range anchors {
+				if !anchorSet[i] {
+					continue
+				}
+				if prev >= 0 {
+					// hold (-) anchors between prev and i interpolate linearly
+					span := anchorPulse[i] - anchorPulse[prev]
+					for p := anchorPulse[prev]; p <= anchorPulse[i]; p++ {
+						frac := 0.0
+						if span > 0 {
+							frac = float64(p-anchorPulse[prev]) / float64(span)
+						}
+						v := float64(anchorValue[prev]) + frac*float64(anchorValue[i]-anchorValue[prev])
+						measure.CCEmit[p] = music.CC{Number: ccNum, Values: []int64{int64(math.Round(v))}}
+					}
+				} else {
+					measure.CCEmit[anchorPulse[i]] = music.CC{Number: ccNum, Values: []int64{anchorValue[i]}}
+				}
+				prev = i
+			}
+		} else if strings.HasPrefix(line, "seed") {
+			fs := strings.Fields(line)
+			if len(fs) > 1 {
+				var seedVal int64
+				seedVal, err = strconv.ParseInt(fs[1], 10, 64)
+				if err != nil {
+					err = fmt.Errorf("problem parsing seed: %s", fs[1])
+					return
+				}
+				rng = rand.New(rand.NewSource(seedVal))
+			}
 		} else if strings.HasPrefix(line, "chain") {
 			fs := strings.Fields(line)
 			if len(fs) > 1 {
@@ -229,14 +960,58 @@ func (s *Sequencer) Parse(fname string) (err error) {
 			for i := range instruments {
 				instruments[i] = strings.TrimSpace(instruments[i])
 			}
-			part = Part{Instruments: instruments, Legato: 100}
+			part = Part{
+				Instruments:      instruments,
+				Legato:           100,
+				Channel:          nextChannel,
+				PulsesPerMeasure: QUARTERNOTES_PER_MEASURE * metronome.PULSES_PER_QUARTER_NOTE,
+			}
+			nextChannel = (nextChannel + 1) % 16
 		} else if len(line) > 0 {
 			measure := Measure{Emit: make(map[int][]music.Chord)}
-			fs := strings.Fields(line)
-			for i, cluster := range fs {
+			var units []string
+			var weights []float64
+			var fs []string
+			fs, err = expandPatternTokens(strings.Fields(line), rng)
+			if err != nil {
+				return
+			}
+			units, weights, err = expandTuplets(fs)
+			if err != nil {
+				return
+			}
+			totalWeight := 0.0
+			for _, w := range weights {
+				totalWeight += w
+			}
+			totalPulsesF := float64(part.PulsesPerMeasure)
+			cum := 0.0
+			for i, cluster := range units {
+				weight := weights[i]
+				thisCum := cum
+				cum += weight
 				if cluster == "." {
 					continue
 				}
+				velocity := int64(100)
+				if idx := strings.Index(cluster, "@"); idx >= 0 {
+					velStr := cluster[idx+1:]
+					cluster = cluster[:idx]
+					v, errV := strconv.ParseInt(velStr, 10, 64)
+					if errV != nil {
+						v, errV = strconv.ParseInt(velStr, 16, 64)
+					}
+					if errV != nil {
+						err = fmt.Errorf("problem parsing velocity: %s", velStr)
+						return
+					}
+					if v < 0 {
+						v = 0
+					} else if v > 127 {
+						v = 127
+					}
+					velocity = v
+				}
 				if strings.HasPrefix(cluster, ":") {
 					// interpret as a chord
 					log.Tracef("parsing '%s'", cluster)
@@ -285,20 +1060,24 @@ func (s *Sequencer) Parse(fname string) (err error) {
 					log.Error(err)
 					return
 				}
-				measure.Chords = append(measure.Chords, music.Chord{Notes: notes})
-				startPulse := float64(i) / float64(len(fs)) * (QUARTERNOTES_PER_MEASURE*metronome.PULSES_PER_QUARTER_NOTE - 1)
-				endPulse := startPulse + float64(part.Legato)/100.0*1/float64(len(fs))*(QUARTERNOTES_PER_MEASURE*metronome.PULSES_PER_QUARTER_NOTE-1)
+				velocities := make([]int64, len(notes))
+				for vi := range velocities {
+					velocities[vi] = velocity
+				}
+				measure.Chords = append(measure.Chords, music.Chord{Notes: notes, Velocities: velocities})
+				startPulse := thisCum / totalWeight * (totalPulsesF - 1)
+				endPulse := startPulse + float64(part.Legato)/100.0*(weight/totalWeight)*(totalPulsesF-1)
 				startPulse = math.Round(startPulse)
 				endPulse = math.Round(endPulse)
 				if startPulse < 0 {
 					startPulse = 0
-				} else if startPulse > (QUARTERNOTES_PER_MEASURE*metronome.PULSES_PER_QUARTER_NOTE - 2) {
-					startPulse = (QUARTERNOTES_PER_MEASURE*metronome.PULSES_PER_QUARTER_NOTE - 2)
+				} else if startPulse > totalPulsesF-2 {
+					startPulse = totalPulsesF - 2
 				}
 				if endPulse < 1 {
 					endPulse = 1
-				} else if endPulse > (QUARTERNOTES_PER_MEASURE*metronome.PULSES_PER_QUARTER_NOTE - 1) {
-					endPulse = (QUARTERNOTES_PER_MEASURE*metronome.PULSES_PER_QUARTER_NOTE - 1)
+				} else if endPulse > totalPulsesF-1 {
+					endPulse = totalPulsesF - 1
 				}
 				if endPulse <= startPulse {
 					endPulse = startPulse + 1
@@ -307,13 +1086,13 @@ func (s *Sequencer) Parse(fname string) (err error) {
 				if _, ok := measure.Emit[int(startPulse)]; !ok {
 					measure.Emit[int(startPulse)] = []music.Chord{}
 				}
-				measure.Emit[int(startPulse)] = append(measure.Emit[int(startPulse)], music.Chord{Notes: notes, On: true})
+				measure.Emit[int(startPulse)] = append(measure.Emit[int(startPulse)], music.Chord{Notes: notes, Velocities: velocities, On: true})
 
 				if !holdNote {
 					if _, ok := measure.Emit[int(endPulse)]; !ok {
 						measure.Emit[int(endPulse)] = []music.Chord{}
 					}
-					measure.Emit[int(endPulse)] = append(measure.Emit[int(endPulse)], music.Chord{Notes: notes, On: false})
+					measure.Emit[int(endPulse)] = append(measure.Emit[int(endPulse)], music.Chord{Notes: notes, Velocities: velocities, On: false})
 				}
 			}
 			part.Measures = append(part.Measures, measure)
@@ -342,20 +1121,15 @@ func (s *Sequencer) Parse(fname string) (err error) {
 				newChain = append(newChain, section.Name)
 			}
 		}
-		for _, chain := range newChain {
-			if _, ok := newChainMap[chain]; !ok {
-				err = fmt.Errorf("no such chain: %s", chain)
+		for _, c := range newChain {
+			if _, ok := newChainMap[c]; !ok {
+				err = fmt.Errorf("no such chain: %s", c)
 				return
 			}
 		}
-		s.Lock()
-		s.chainID = make(map[string]int)
-		for k := range newChainMap {
-			s.chainID[k] = newChainMap[k]
-		}
-		s.chain = newChain
-		s.Sections = newSections
-		s.Unlock()
+		chainID = newChainMap
+		chain = newChain
+		sections = newSections
 	} else {
 		err = fmt.Errorf("no sections found in data:\n----\n%s\n-----", data)
 	}
@@ -0,0 +1,392 @@
+package sequencer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/schollz/miti/src/metronome"
+	"github.com/schollz/miti/src/music"
+)
+
+func parseSequencer(t *testing.T, src string, midiPlay func(string, int64, music.Chord, *music.CC)) *Sequencer {
+	t.Helper()
+	f, err := ioutil.TempFile("", "miti-*.miti")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(src); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s := New(false, 0, midiPlay, SyncNone, "")
+	if err := s.Parse(f.Name()); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	return s
+}
+
+// TestTupletPolyrhythm3Against4 packs 3 evenly-spaced notes into the same
+// measure duration as 4 evenly-spaced notes via the "(3 4 ...)" tuplet
+// form, and checks the two parts' onsets only coincide at the downbeat -
+// the textbook 3-against-4 cross-rhythm.
+func TestTupletPolyrhythm3Against4(t *testing.T) {
+	src := `
+pattern main
+instruments kick
+C4 C4 C4 C4
+
+instruments clave
+(3 4 C4 C4 C4)
+`
+	var kickPulses, clavePulses []int
+	var s *Sequencer
+	s = parseSequencer(t, src, func(instrument string, channel int64, chord music.Chord, cc *music.CC) {
+		if !chord.On || len(chord.Notes) == 0 {
+			return
+		}
+		switch instrument {
+		case "kick":
+			kickPulses = append(kickPulses, int(s.totalPulse))
+		case "clave":
+			clavePulses = append(clavePulses, int(s.totalPulse))
+		}
+	})
+
+	pulsesPerMeasure := QUARTERNOTES_PER_MEASURE * metronome.PULSES_PER_QUARTER_NOTE
+	for i := 0; i < pulsesPerMeasure; i++ {
+		s.Emit(i)
+	}
+
+	if len(kickPulses) != 4 {
+		t.Fatalf("expected 4 kick onsets, got %d: %v", len(kickPulses), kickPulses)
+	}
+	if len(clavePulses) != 3 {
+		t.Fatalf("expected 3 clave onsets, got %d: %v", len(clavePulses), clavePulses)
+	}
+	shared := 0
+	for _, cp := range clavePulses {
+		for _, kp := range kickPulses {
+			if cp == kp {
+				shared++
+			}
+		}
+	}
+	if shared != 1 {
+		t.Errorf("expected kick and clave onsets to coincide only at the downbeat, got %d shared onsets (kick=%v clave=%v)", shared, kickPulses, clavePulses)
+	}
+}
+
+// TestMeterWrapsIndependently checks that a part with its own `meter`
+// directive cycles through its Measures off its own pulse count, not the
+// section's default 4/4 measure count.
+func TestMeterWrapsIndependently(t *testing.T) {
+	src := `
+pattern main
+instruments melody
+meter 3/4
+C4 D4 E4
+F4 G4 A4
+`
+	var hits []int
+	s := parseSequencer(t, src, func(instrument string, channel int64, chord music.Chord, cc *music.CC) {
+		if chord.On && len(chord.Notes) > 0 {
+			hits = append(hits, chord.Notes[0].MIDI)
+		}
+	})
+
+	part := s.Sections[0].Parts[0]
+	wantPPM := int(3.0 / 4.0 * 4 * metronome.PULSES_PER_QUARTER_NOTE)
+	if part.PulsesPerMeasure != wantPPM {
+		t.Fatalf("expected PulsesPerMeasure %d for meter 3/4, got %d", wantPPM, part.PulsesPerMeasure)
+	}
+
+	// run past the end of the part's own (short) measure and confirm it
+	// has rolled over to its second Measure, independent of the global
+	// 4/4 pulse grid the metronome hands in.
+	for i := 0; i < part.PulsesPerMeasure+1; i++ {
+		s.Emit(i % (QUARTERNOTES_PER_MEASURE * metronome.PULSES_PER_QUARTER_NOTE))
+	}
+	if len(hits) == 0 {
+		t.Fatal("expected melody to emit at least once")
+	}
+	want := part.Measures[1].Chords[0].Notes[0].MIDI
+	if last := hits[len(hits)-1]; last != want {
+		t.Fatalf("expected pulse %d to start the part's second measure (note %d), last onset was %d", part.PulsesPerMeasure, want, last)
+	}
+}
+
+// TestRenderDeterministic checks that Render never touches portmidi (it
+// takes no midiPlay at all) and that rendering the same parsed sequence
+// twice produces byte-identical SMF output, the property the golden-file
+// parser test harness described in the request depends on.
+func TestRenderDeterministic(t *testing.T) {
+	src := `
+pattern main
+instruments kick
+C4 C4 C4 C4
+`
+	s := parseSequencer(t, src, func(string, int64, music.Chord, *music.CC) {
+		t.Fatal("Render must not invoke midiPlay")
+	})
+
+	var first, second bytes.Buffer
+	if err := s.Render(&first, 2); err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if err := s.Render(&second, 2); err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Fatal("expected two renders of the same sequence to be byte-identical")
+	}
+
+	header := first.Bytes()[:4]
+	if string(header) != "MThd" {
+		t.Fatalf("expected MThd header, got %q", header)
+	}
+	format := first.Bytes()[8:10]
+	if format[0] != 0 || format[1] != 1 {
+		t.Fatalf("expected SMF format 1, got %v", format)
+	}
+}
+
+// TestEuclideanRhythm checks that "E(3,8) C4" lands hits at exactly the
+// Bjorklund-distributed positions of a classic 3-over-8 tresillo: steps
+// 0, 3 and 6 of an 8-step line.
+func TestEuclideanRhythm(t *testing.T) {
+	src := `
+pattern main
+instruments drum
+E(3,8) C4
+`
+	var hitPulses []int
+	var s *Sequencer
+	s = parseSequencer(t, src, func(instrument string, channel int64, chord music.Chord, cc *music.CC) {
+		if chord.On && len(chord.Notes) > 0 {
+			hitPulses = append(hitPulses, int(s.totalPulse))
+		}
+	})
+
+	pulsesPerMeasure := QUARTERNOTES_PER_MEASURE * metronome.PULSES_PER_QUARTER_NOTE
+	for i := 0; i < pulsesPerMeasure; i++ {
+		s.Emit(i)
+	}
+
+	if len(hitPulses) != 3 {
+		t.Fatalf("expected 3 euclidean hits, got %d: %v", len(hitPulses), hitPulses)
+	}
+	// Bjorklund(3,8) hits land at step indices 0, 3 and 6 of the 8-step
+	// line; the parser spaces a line's units across the part's pulses
+	// with the same round(i/8*(pulsesPerMeasure-1)) formula as any other
+	// pattern line, so compute the expected pulses the same way rather
+	// than assuming evenly-sized step buckets.
+	wantPulses := map[int]bool{}
+	for _, step := range []int{0, 3, 6} {
+		wantPulses[int(math.Round(float64(step)/8*float64(pulsesPerMeasure-1)))] = true
+	}
+	for _, p := range hitPulses {
+		if !wantPulses[p] {
+			t.Errorf("unexpected hit pulse %d, want one of %v", p, wantPulses)
+		}
+	}
+}
+
+// TestEuclideanRhythmZeroHits checks that "E(0,n)" (all rests) returns
+// promptly instead of spinning forever: bjorklund's loop only shrinks
+// the remainder when both front and back start non-empty.
+func TestEuclideanRhythmZeroHits(t *testing.T) {
+	done := make(chan []bool, 1)
+	go func() { done <- bjorklund(0, 4) }()
+	select {
+	case hits := <-done:
+		for i, h := range hits {
+			if h {
+				t.Errorf("expected all rests for E(0,4), got a hit at step %d: %v", i, hits)
+			}
+		}
+	case <-time.After(time.Second):
+		t.Fatal("bjorklund(0, 4) did not return")
+	}
+}
+
+// TestCCNumberClamped checks that an out-of-range controller number on a
+// cc line is clamped to the valid 0-127 range, the same way cc values
+// already are.
+func TestCCNumberClamped(t *testing.T) {
+	src := `
+pattern main
+instruments synth
+C4
+cc 200 64
+`
+	s := parseSequencer(t, src, func(string, int64, music.Chord, *music.CC) {})
+
+	measure := s.Sections[0].Parts[0].Measures[0]
+	found := false
+	for _, cc := range measure.CCEmit {
+		found = true
+		if cc.Number != 127 {
+			t.Fatalf("expected out-of-range cc number 200 to clamp to 127, got %d", cc.Number)
+		}
+	}
+	if !found {
+		t.Fatal("expected at least one CCEmit entry")
+	}
+}
+
+// TestPartMeasureResetsAtSectionStart checks that a default-meter part's
+// measure cursor restarts at Measures[0] when a new section begins,
+// rather than continuing to index off the pulse count accumulated since
+// the whole piece started. Section "two"'s kick has an all-rest measure
+// first and an all-hits measure second; if the cursor doesn't reset, the
+// part would wrongly land on the all-hits measure as soon as playback
+// crosses into section "two".
+func TestPartMeasureResetsAtSectionStart(t *testing.T) {
+	src := `
+pattern one
+instruments kick
+C4
+
+pattern two
+instruments kick
+. . . .
+C4 C4 C4 C4
+`
+	var onsetsInSecondSection int
+	inSecondSection := false
+	s := parseSequencer(t, src, func(instrument string, channel int64, chord music.Chord, cc *music.CC) {
+		if chord.On && len(chord.Notes) > 0 && inSecondSection {
+			onsetsInSecondSection++
+		}
+	})
+
+	s.Start()
+	pulsesPerMeasure := QUARTERNOTES_PER_MEASURE * metronome.PULSES_PER_QUARTER_NOTE
+	for i := 0; i < pulsesPerMeasure; i++ {
+		s.Emit(i)
+	}
+	inSecondSection = true
+	for i := 0; i < pulsesPerMeasure; i++ {
+		s.Emit(i)
+	}
+
+	if onsetsInSecondSection != 0 {
+		t.Fatalf("expected section two's first measure (all rests) to stay silent, got %d onsets", onsetsInSecondSection)
+	}
+}
+
+// TestSwapShadowResetsSectionIndex checks that hot-reloading into a
+// shorter (or reordered) chain mid-playback doesn't leave s.section/
+// s.sectionID/s.measure indexing the old, now-gone chain, which used to
+// panic with "index out of range" the next time Emit ran.
+func TestSwapShadowResetsSectionIndex(t *testing.T) {
+	src := `
+pattern one
+instruments kick
+C4
+
+pattern two
+instruments kick
+C4
+
+pattern three
+instruments kick
+C4
+`
+	s := parseSequencer(t, src, func(string, int64, music.Chord, *music.CC) {})
+
+	// start mid-chain, one pulse away from wrapping back to measure 0 -
+	// the exact moment a real section-boundary crossing happens.
+	s.section = 1
+	s.sectionID = s.chainID[s.chain[1]]
+	s.measure = s.Sections[s.sectionID].NumMeasures - 1
+
+	// stage a 1-section shadow, shorter than the 3-section chain
+	// currently playing.
+	s.Lock()
+	s.shadowChain = []string{"one"}
+	s.shadowChainID = map[string]int{"one": 0}
+	s.shadowSection = []Section{s.Sections[0]}
+	s.shadowPending = true
+	s.Unlock()
+
+	s.Emit(0)
+
+	if s.section != 0 || s.sectionID != 0 || s.measure != 0 {
+		t.Fatalf("expected swap to reset section/sectionID/measure to 0, got section=%d sectionID=%d measure=%d", s.section, s.sectionID, s.measure)
+	}
+}
+
+// TestRandomChoiceRejectsEmptyAlternative checks that "[C4|]" - a random
+// choice with a blank alternative - fails to parse instead of only
+// failing intermittently whenever rng happens to land on the empty
+// option.
+func TestRandomChoiceRejectsEmptyAlternative(t *testing.T) {
+	src := `
+pattern main
+instruments kick
+[C4|]
+`
+	for i := 0; i < 20; i++ {
+		f, err := ioutil.TempFile("", "miti-*.miti")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteString(src); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		s := New(false, 0, func(string, int64, music.Chord, *music.CC) {}, SyncNone, "")
+		if err := s.Parse(f.Name()); err == nil {
+			os.Remove(f.Name())
+			t.Fatalf("expected Parse to reject an empty random-choice alternative, run %d succeeded", i)
+		}
+		os.Remove(f.Name())
+	}
+}
+
+// TestSeedReproducible checks that a `seed N` directive makes the
+// probability gate and random-choice tokens deterministic: reparsing the
+// same file with the same seed must produce identical emitted notes.
+func TestSeedReproducible(t *testing.T) {
+	src := `
+pattern main
+seed 42
+instruments lead
+?0.5:C4 ?0.5:D4 ?0.5:E4 ?0.5:F4
+instruments choice
+[C4|D4|E4|F4] [C4|D4|E4|F4] [C4|D4|E4|F4] [C4|D4|E4|F4]
+`
+	record := func() []int {
+		var notes []int
+		s := parseSequencer(t, src, func(instrument string, channel int64, chord music.Chord, cc *music.CC) {
+			if chord.On {
+				for _, n := range chord.Notes {
+					notes = append(notes, n.MIDI)
+				}
+			}
+		})
+		pulsesPerMeasure := QUARTERNOTES_PER_MEASURE * metronome.PULSES_PER_QUARTER_NOTE
+		for i := 0; i < pulsesPerMeasure; i++ {
+			s.Emit(i)
+		}
+		return notes
+	}
+
+	first := record()
+	second := record()
+	if len(first) != len(second) {
+		t.Fatalf("expected identical note counts across runs, got %d and %d", len(first), len(second))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected identical notes across runs with the same seed, diverged at %d: %v vs %v", i, first, second)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package sequencer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/schollz/miti/src/metronome"
+	"github.com/schollz/miti/src/music"
+)
+
+// smfEvent is one channel-voice or meta event scheduled at an absolute
+// tick, ready to be delta-encoded once its track is sorted.
+type smfEvent struct {
+	tick  int64
+	bytes []byte
+}
+
+// Render walks Sections/chain for bars measures - the same way Emit does,
+// but without a metronome or portmidi - and writes a type-1 Standard
+// MIDI File to w: a leading tempo/meta track plus one track per unique
+// instrument. Internal pulses map 1:1 onto SMF ticks (division is
+// metronome.PULSES_PER_QUARTER_NOTE), so the render is deterministic and
+// needs no live MIDI device, making it usable both to export a .mid for
+// a DAW and as a golden-byte test harness for the parser.
+func (s *Sequencer) Render(w io.Writer, bars int) (err error) {
+	if len(s.Sections) == 0 || len(s.chain) == 0 {
+		err = fmt.Errorf("nothing to render: no sections parsed")
+		return
+	}
+	if bars <= 0 {
+		err = fmt.Errorf("bars must be positive, got %d", bars)
+		return
+	}
+
+	const division = metronome.PULSES_PER_QUARTER_NOTE
+	measurePulses := QUARTERNOTES_PER_MEASURE * division
+
+	tempoTrack := []smfEvent{}
+	trackEvents := map[string][]smfEvent{}
+
+	section := 0
+	measure := 0
+	sectionID := s.chainID[s.chain[section]]
+	lastTempo := 0.0
+
+	var totalPulse, sectionStartPulse int64
+	for bar := 0; bar < bars; bar++ {
+		sec := s.Sections[sectionID]
+		if sec.Tempo != 0 && sec.Tempo != lastTempo {
+			tempoTrack = append(tempoTrack, smfEvent{tick: totalPulse, bytes: tempoMetaEvent(sec.Tempo)})
+			lastTempo = sec.Tempo
+		}
+		for pulse := 0; pulse < measurePulses; pulse++ {
+			sectionPulse := totalPulse - sectionStartPulse
+			for _, part := range sec.Parts {
+				if len(part.Measures) == 0 {
+					continue
+				}
+				pulsesPerMeasure := part.PulsesPerMeasure
+				if pulsesPerMeasure <= 0 {
+					pulsesPerMeasure = measurePulses
+				}
+				partPulse := int(sectionPulse % int64(pulsesPerMeasure))
+				partMeasureIdx := int((sectionPulse / int64(pulsesPerMeasure)) % int64(len(part.Measures)))
+				partMeasure := part.Measures[partMeasureIdx]
+				if e, ok := partMeasure.Emit[partPulse]; ok {
+					chordOff := music.Chord{On: false}
+					chordOn := music.Chord{On: true}
+					for _, chord := range e {
+						if chord.On {
+							chordOn.Notes = append(chordOn.Notes, chord.Notes...)
+							chordOn.Velocities = append(chordOn.Velocities, chord.Velocities...)
+						} else {
+							chordOff.Notes = append(chordOff.Notes, chord.Notes...)
+							chordOff.Velocities = append(chordOff.Velocities, chord.Velocities...)
+						}
+					}
+					for _, instrument := range part.Instruments {
+						if len(chordOff.Notes) > 0 {
+							trackEvents[instrument] = append(trackEvents[instrument], noteEvents(totalPulse, 0x80|part.Channel, chordOff)...)
+						}
+						if len(chordOn.Notes) > 0 {
+							trackEvents[instrument] = append(trackEvents[instrument], noteEvents(totalPulse, 0x90|part.Channel, chordOn)...)
+						}
+					}
+				}
+				if cc, ok := partMeasure.CCEmit[partPulse]; ok {
+					for _, instrument := range part.Instruments {
+						for _, v := range cc.Values {
+							trackEvents[instrument] = append(trackEvents[instrument], smfEvent{
+								tick:  totalPulse,
+								bytes: []byte{byte(0xB0 | part.Channel), byte(cc.Number), byte(v)},
+							})
+						}
+					}
+				}
+			}
+			totalPulse++
+		}
+		measure++
+		if measure == sec.NumMeasures {
+			section++
+			section = section % len(s.chain)
+			sectionID = s.chainID[s.chain[section]]
+			measure = 0
+			sectionStartPulse = totalPulse
+		}
+	}
+
+	instruments := make([]string, 0, len(trackEvents))
+	for instrument := range trackEvents {
+		instruments = append(instruments, instrument)
+	}
+	sort.Strings(instruments)
+
+	tracks := [][]byte{encodeTrack(tempoTrack, "tempo")}
+	for _, instrument := range instruments {
+		events := trackEvents[instrument]
+		sort.SliceStable(events, func(i, j int) bool { return events[i].tick < events[j].tick })
+		tracks = append(tracks, encodeTrack(events, instrument))
+	}
+
+	_, err = w.Write(smfHeader(len(tracks), division))
+	if err != nil {
+		return
+	}
+	for _, track := range tracks {
+		if _, err = w.Write(track); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// noteEvents expands chord into one smfEvent per note, all at the same
+// tick, each carrying status (0x90|channel or 0x80|channel) and that
+// note's velocity (falling back to 100, matching midi.Midi).
+func noteEvents(tick int64, status int64, chord music.Chord) (events []smfEvent) {
+	for i, n := range chord.Notes {
+		velocity := int64(100)
+		if i < len(chord.Velocities) {
+			velocity = chord.Velocities[i]
+		}
+		events = append(events, smfEvent{
+			tick:  tick,
+			bytes: []byte{byte(status), byte(n.MIDI), byte(velocity)},
+		})
+	}
+	return
+}
+
+// tempoMetaEvent builds an FF 51 03 set-tempo meta event for bpm.
+func tempoMetaEvent(bpm float64) []byte {
+	microsPerQuarter := uint32(60000000.0 / bpm)
+	return []byte{
+		0xFF, 0x51, 0x03,
+		byte(microsPerQuarter >> 16),
+		byte(microsPerQuarter >> 8),
+		byte(microsPerQuarter),
+	}
+}
+
+// encodeTrack delta-encodes events (already sorted by tick) into a
+// complete MTrk chunk, appending the mandatory end-of-track meta event.
+func encodeTrack(events []smfEvent, name string) []byte {
+	var data bytes.Buffer
+	data.Write(vlq(0))
+	data.Write([]byte{0xFF, 0x03, byte(len(name))})
+	data.WriteString(name)
+
+	var lastTick int64
+	for _, e := range events {
+		data.Write(vlq(e.tick - lastTick))
+		data.Write(e.bytes)
+		lastTick = e.tick
+	}
+	data.Write(vlq(0))
+	data.Write([]byte{0xFF, 0x2F, 0x00})
+
+	var chunk bytes.Buffer
+	chunk.WriteString("MTrk")
+	chunk.Write(beUint32(uint32(data.Len())))
+	chunk.Write(data.Bytes())
+	return chunk.Bytes()
+}
+
+// smfHeader builds the MThd chunk for a type-1 file with ntracks tracks
+// and the given ticks-per-quarter-note division.
+func smfHeader(ntracks int, division int) []byte {
+	var h bytes.Buffer
+	h.WriteString("MThd")
+	h.Write(beUint32(6))
+	h.Write(beUint16(1))
+	h.Write(beUint16(uint16(ntracks)))
+	h.Write(beUint16(uint16(division)))
+	return h.Bytes()
+}
+
+// vlq encodes n as a MIDI variable-length quantity (big-endian, 7 bits
+// per byte, high bit set on every byte but the last).
+func vlq(n int64) []byte {
+	if n < 0 {
+		n = 0
+	}
+	buf := []byte{byte(n & 0x7f)}
+	n >>= 7
+	for n > 0 {
+		buf = append([]byte{byte(n&0x7f) | 0x80}, buf...)
+		n >>= 7
+	}
+	return buf
+}
+
+func beUint32(n uint32) []byte {
+	return []byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func beUint16(n uint16) []byte {
+	return []byte{byte(n >> 8), byte(n)}
+}